@@ -0,0 +1,410 @@
+// Copyright 2020 Jared Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package proxier
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// endpointSliceServiceNameLabel is set by Kubernetes on every
+// EndpointSlice that belongs to a Service, pointing back at it.
+const endpointSliceServiceNameLabel = "kubernetes.io/service-name"
+
+// ingressDiscoverer implements ResourceDiscoverer for
+// networkingv1.Ingress, exposing one Service per rule host.
+type ingressDiscoverer struct {
+	k kubernetes.Interface
+}
+
+func (d *ingressDiscoverer) Discover(ctx context.Context, opts DiscoverOptions) ([]*Service, error) {
+	s := make([]*Service, 0)
+	for _, ns := range namespacesFor(opts) {
+		found, err := d.discoverNamespace(ctx, ns, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		s = append(s, found...)
+	}
+
+	if opts.ExcludeSystemNamespaces {
+		s = excludeSystemNamespaces(s)
+	}
+
+	return s, nil
+}
+
+func (d *ingressDiscoverer) discoverNamespace(ctx context.Context, namespace string, opts DiscoverOptions) ([]*Service, error) {
+	listOpts := listOptionsFor(opts)
+	cont := ""
+
+	s := make([]*Service, 0)
+	for {
+		listOpts.Continue = cont
+		l, err := d.k.NetworkingV1().Ingresses(namespace).List(ctx, listOpts)
+		if kerrors.IsResourceExpired(err) {
+			s = make([]*Service, 0)
+			cont = ""
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to retrieve kubernetes ingresses in namespace %q", namespace)
+		}
+
+		for i := range l.Items {
+			ing := &l.Items[i]
+			if ing.Annotations[ExposeAnnotation] == "false" {
+				continue
+			}
+
+			found, err := d.servicesFromIngress(ctx, ing)
+			if err != nil {
+				return nil, err
+			}
+
+			s = append(s, found...)
+		}
+
+		if l.Continue == "" {
+			break
+		}
+
+		cont = l.Continue
+	}
+
+	return s, nil
+}
+
+// servicesFromIngress converts each host rule of an Ingress into its
+// own Service, with ports sourced from the rule's backend service
+// ports and locally remappable via the usual RemapAnnotationPrefix
+// annotations. The remap annotation is keyed by port *name*, so
+// numeric-only backends (the common case) need their referenced
+// Service resolved to learn it.
+func (d *ingressDiscoverer) servicesFromIngress(ctx context.Context, ing *networkingv1.Ingress) ([]*Service, error) {
+	remaps := remapsFromAnnotations(ing.Annotations)
+
+	s := make([]*Service, 0, len(ing.Spec.Rules))
+	for _, rule := range ing.Spec.Rules {
+		if rule.Host == "" || rule.HTTP == nil {
+			continue
+		}
+
+		serv := &Service{
+			Name:      ing.Name,
+			Namespace: ing.Namespace,
+			Host:      rule.Host,
+			Ports:     make([]*ServicePort, 0),
+		}
+
+		for _, path := range rule.HTTP.Paths {
+			backend := path.Backend.Service
+			if backend == nil || backend.Port.Number == 0 {
+				// named backend ports require resolving the referenced
+				// Service to know the numeric port, which the Ingress
+				// discoverer doesn't do; skip them for now.
+				continue
+			}
+
+			portName, err := d.backendPortName(ctx, ing.Namespace, backend)
+			if err != nil {
+				return nil, err
+			}
+
+			// Ingress backends are always plain HTTP(S) over TCP.
+			localPort := uint(backend.Port.Number)
+			if override := remaps[remapKey(strings.ToLower(portName), corev1.ProtocolTCP)]; override != 0 {
+				localPort = override
+			}
+
+			serv.Ports = append(serv.Ports, &ServicePort{
+				RemotePort: uint(backend.Port.Number),
+				LocalPort:  localPort,
+				Protocol:   corev1.ProtocolTCP,
+			})
+		}
+
+		if len(serv.Ports) > 0 {
+			s = append(s, serv)
+		}
+	}
+
+	return s, nil
+}
+
+// backendPortName returns the port name of an Ingress backend, used to
+// look the backend's port up in the RemapAnnotationPrefix annotations.
+// backend.Port.Name is only set when the Ingress itself references the
+// port by name; for the far more common numeric backend, the
+// referenced Service has to be resolved to learn its port's name.
+func (d *ingressDiscoverer) backendPortName(
+	ctx context.Context, namespace string, backend *networkingv1.IngressServiceBackend,
+) (string, error) {
+	if backend.Port.Name != "" {
+		return backend.Port.Name, nil
+	}
+
+	svc, err := d.k.CoreV1().Services(namespace).Get(ctx, backend.Name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve ingress backend service %s/%s", namespace, backend.Name)
+	}
+
+	for _, p := range svc.Spec.Ports {
+		if p.Port == backend.Port.Number {
+			return p.Name, nil
+		}
+	}
+
+	return "", nil
+}
+
+// endpointSliceDiscoverer implements ResourceDiscoverer for
+// discoveryv1.EndpointSlice, exposing one Service per endpoint
+// address so callers can reach backends that have no ClusterIP of
+// their own, e.g. externally-managed backends.
+type endpointSliceDiscoverer struct {
+	k kubernetes.Interface
+}
+
+func (d *endpointSliceDiscoverer) Discover(ctx context.Context, opts DiscoverOptions) ([]*Service, error) {
+	s := make([]*Service, 0)
+	for _, ns := range namespacesFor(opts) {
+		found, err := d.discoverNamespace(ctx, ns, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		s = append(s, found...)
+	}
+
+	if opts.ExcludeSystemNamespaces {
+		s = excludeSystemNamespaces(s)
+	}
+
+	return s, nil
+}
+
+func (d *endpointSliceDiscoverer) discoverNamespace(ctx context.Context, namespace string, opts DiscoverOptions) ([]*Service, error) {
+	listOpts := listOptionsFor(opts)
+	cont := ""
+
+	s := make([]*Service, 0)
+	for {
+		listOpts.Continue = cont
+		l, err := d.k.DiscoveryV1().EndpointSlices(namespace).List(ctx, listOpts)
+		if kerrors.IsResourceExpired(err) {
+			s = make([]*Service, 0)
+			cont = ""
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to retrieve kubernetes endpoint slices in namespace %q", namespace)
+		}
+
+		for i := range l.Items {
+			slice := &l.Items[i]
+			if slice.Annotations[ExposeAnnotation] == "false" {
+				continue
+			}
+
+			// slices belonging to a Service are reached through that
+			// Service (or headlessServiceDiscoverer), not exposed again here
+			if slice.Labels[endpointSliceServiceNameLabel] != "" {
+				continue
+			}
+
+			s = append(s, servicesFromEndpointSlice(slice)...)
+		}
+
+		if l.Continue == "" {
+			break
+		}
+
+		cont = l.Continue
+	}
+
+	return s, nil
+}
+
+// mergeAnnotations returns a map containing base's entries overlaid
+// with override's, without mutating either argument.
+func mergeAnnotations(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
+	}
+
+	merged := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// servicesFromEndpointSlice converts every ready address in an
+// EndpointSlice into its own Service, keyed by the slice's
+// owning-Service name (or the slice's own name, if it has none).
+func servicesFromEndpointSlice(slice *discoveryv1.EndpointSlice) []*Service {
+	return servicesFromEndpointSliceWithAnnotations(slice, nil)
+}
+
+// servicesFromEndpointSliceWithAnnotations is servicesFromEndpointSlice,
+// but also honors remap annotations from ownerAnnotations. EndpointSlices
+// don't carry a Service's user annotations themselves (Kubernetes only
+// copies a couple of controller-owned labels onto them), so
+// headlessServiceDiscoverer passes the headless Service's own
+// Annotations here to keep remap annotations working for it. The
+// slice's own annotations, if any, take precedence on conflict.
+func servicesFromEndpointSliceWithAnnotations(slice *discoveryv1.EndpointSlice, ownerAnnotations map[string]string) []*Service {
+	name := slice.Labels[endpointSliceServiceNameLabel]
+	if name == "" {
+		name = slice.Name
+	}
+
+	remaps := remapsFromAnnotations(mergeAnnotations(ownerAnnotations, slice.Annotations))
+
+	ports := make([]*ServicePort, 0, len(slice.Ports))
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+
+		protocol := corev1.ProtocolTCP
+		if p.Protocol != nil {
+			protocol = *p.Protocol
+		}
+
+		remotePort := uint(*p.Port)
+		localPort := remotePort
+		if p.Name != nil {
+			if override := remaps[remapKey(strings.ToLower(*p.Name), protocol)]; override != 0 {
+				localPort = override
+			}
+		}
+
+		ports = append(ports, &ServicePort{RemotePort: remotePort, LocalPort: localPort, Protocol: protocol})
+	}
+
+	s := make([]*Service, 0, len(slice.Endpoints))
+	for _, ep := range slice.Endpoints {
+		if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+			continue
+		}
+
+		for _, addr := range ep.Addresses {
+			s = append(s, &Service{
+				Name:          name,
+				Namespace:     slice.Namespace,
+				RemoteAddress: addr,
+				Ports:         ports,
+			})
+		}
+	}
+
+	return s
+}
+
+// headlessServiceDiscoverer implements ResourceDiscoverer for
+// headless (ClusterIP: None) Services, which have no ClusterIP to
+// dial, by resolving their backing EndpointSlices into per-address
+// Services instead.
+type headlessServiceDiscoverer struct {
+	k kubernetes.Interface
+}
+
+func (d *headlessServiceDiscoverer) Discover(ctx context.Context, opts DiscoverOptions) ([]*Service, error) {
+	s := make([]*Service, 0)
+	for _, ns := range namespacesFor(opts) {
+		found, err := d.discoverNamespace(ctx, ns, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		s = append(s, found...)
+	}
+
+	if opts.ExcludeSystemNamespaces {
+		s = excludeSystemNamespaces(s)
+	}
+
+	return s, nil
+}
+
+func (d *headlessServiceDiscoverer) discoverNamespace(ctx context.Context, namespace string, opts DiscoverOptions) ([]*Service, error) {
+	listOpts := listOptionsFor(opts)
+	cont := ""
+
+	s := make([]*Service, 0)
+	for {
+		listOpts.Continue = cont
+		l, err := d.k.CoreV1().Services(namespace).List(ctx, listOpts)
+		if kerrors.IsResourceExpired(err) {
+			s = make([]*Service, 0)
+			cont = ""
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to retrieve kubernetes services in namespace %q", namespace)
+		}
+
+		for i := range l.Items {
+			kserv := &l.Items[i]
+			if kserv.Spec.ClusterIP != corev1NoneClusterIP {
+				continue
+			}
+
+			if kserv.Annotations[ExposeAnnotation] == "false" {
+				continue
+			}
+
+			slices, err := d.k.DiscoveryV1().EndpointSlices(kserv.Namespace).List(ctx, metav1.ListOptions{
+				LabelSelector: endpointSliceServiceNameLabel + "=" + kserv.Name,
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to retrieve endpoint slices for headless service %s/%s",
+					kserv.Namespace, kserv.Name)
+			}
+
+			for j := range slices.Items {
+				// EndpointSlices don't copy a Service's user annotations, so
+				// the headless Service's remap annotations have to be passed
+				// through explicitly here to not be silently dropped.
+				s = append(s, servicesFromEndpointSliceWithAnnotations(&slices.Items[j], kserv.Annotations)...)
+			}
+		}
+
+		if l.Continue == "" {
+			break
+		}
+
+		cont = l.Continue
+	}
+
+	return s, nil
+}
+
+// corev1NoneClusterIP is the ClusterIP value Kubernetes sets on
+// headless Services.
+const corev1NoneClusterIP = "None"
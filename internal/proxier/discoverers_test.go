@@ -0,0 +1,174 @@
+// Copyright 2020 Jared Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package proxier
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHeadlessServiceDiscovererHonorsServiceRemapAnnotations(t *testing.T) {
+	kserv := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "dns",
+			Namespace: "default",
+			Annotations: map[string]string{
+				RemapAnnotationPrefix + "dns-udp": "5353",
+			},
+		},
+		Spec: corev1.ServiceSpec{ClusterIP: corev1NoneClusterIP},
+	}
+
+	port := int32(53)
+	portName := "dns"
+	protocol := corev1.ProtocolUDP
+	ready := true
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "dns-abc123",
+			Namespace: "default",
+			Labels:    map[string]string{endpointSliceServiceNameLabel: "dns"},
+		},
+		Ports: []discoveryv1.EndpointPort{
+			{Name: &portName, Port: &port, Protocol: &protocol},
+		},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+		},
+	}
+
+	d := &headlessServiceDiscoverer{k: fake.NewSimpleClientset(kserv, slice)}
+
+	services, err := d.discoverNamespace(context.Background(), "default", DiscoverOptions{})
+	if err != nil {
+		t.Fatalf("discoverNamespace: %v", err)
+	}
+
+	if len(services) != 1 || len(services[0].Ports) != 1 {
+		t.Fatalf("got %+v, want a single service with a single port", services)
+	}
+
+	if got := services[0].Ports[0].LocalPort; got != 5353 {
+		t.Errorf("LocalPort = %d, want remapped 5353 from the headless Service's annotations", got)
+	}
+}
+
+func TestIngressDiscovererResolvesBackendPortNameForRemap(t *testing.T) {
+	backendSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+
+	pathType := networkingv1.PathTypePrefix
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			Annotations: map[string]string{
+				RemapAnnotationPrefix + "http": "18080",
+			},
+		},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{
+				{
+					Host: "web.example.com",
+					IngressRuleValue: networkingv1.IngressRuleValue{
+						HTTP: &networkingv1.HTTPIngressRuleValue{
+							Paths: []networkingv1.HTTPIngressPath{
+								{
+									PathType: &pathType,
+									Backend: networkingv1.IngressBackend{
+										Service: &networkingv1.IngressServiceBackend{
+											Name: "web",
+											Port: networkingv1.ServiceBackendPort{Number: 80},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	d := &ingressDiscoverer{k: fake.NewSimpleClientset(backendSvc)}
+
+	services, err := d.servicesFromIngress(context.Background(), ing)
+	if err != nil {
+		t.Fatalf("servicesFromIngress: %v", err)
+	}
+
+	if len(services) != 1 || len(services[0].Ports) != 1 {
+		t.Fatalf("got %+v, want a single service with a single port", services)
+	}
+
+	if got := services[0].Ports[0].LocalPort; got != 18080 {
+		t.Errorf("LocalPort = %d, want remapped 18080 (backend.Name %q must not be used as the port name)", got, "web")
+	}
+}
+
+func TestServicesFromEndpointSlice(t *testing.T) {
+	port := int32(53)
+	portName := "dns"
+	protocol := corev1.ProtocolUDP
+	ready := true
+
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "dns-abc123",
+			Namespace: "default",
+			Labels:    map[string]string{endpointSliceServiceNameLabel: "dns"},
+			Annotations: map[string]string{
+				RemapAnnotationPrefix + "dns-udp": "5353",
+			},
+		},
+		Ports: []discoveryv1.EndpointPort{
+			{Name: &portName, Port: &port, Protocol: &protocol},
+		},
+		Endpoints: []discoveryv1.Endpoint{
+			{
+				Addresses:  []string{"10.0.0.1", "10.0.0.2"},
+				Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+			},
+		},
+	}
+
+	services := servicesFromEndpointSlice(slice)
+	if len(services) != 2 {
+		t.Fatalf("got %d services, want one per address", len(services))
+	}
+
+	for _, s := range services {
+		if s.Name != "dns" {
+			t.Errorf("Name = %q, want owning Service name %q", s.Name, "dns")
+		}
+
+		if s.RemoteAddress == "" {
+			t.Error("RemoteAddress not set")
+		}
+
+		if len(s.Ports) != 1 || s.Ports[0].LocalPort != 5353 {
+			t.Errorf("Ports = %+v, want single remapped UDP port 5353", s.Ports)
+		}
+	}
+}
@@ -17,23 +17,49 @@ import (
 	"context"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
 const (
 	RemapAnnotationPrefix = "localizer.jaredallard.github.com/remap-"
+
+	// ExposeAnnotation lets a Service owner opt out of discovery even
+	// when it matches the namespace/label/field selectors passed to
+	// Discover, by setting it to "false".
+	ExposeAnnotation = "localizer.jaredallard.github.com/expose"
 )
 
+// systemNamespaces are the namespaces excluded from Discover's results
+// when DiscoverOptions.ExcludeSystemNamespaces is set.
+var systemNamespaces = map[string]bool{
+	"kube-system":     true,
+	"kube-public":     true,
+	"kube-node-lease": true,
+}
+
 // Service represents a Service running in Kubernetes
 // that should be proxied local <-> remote
 type Service struct {
 	Name      string
 	Namespace string
 	Ports     []*ServicePort
+
+	// Host is the external host this Service should be reachable at, as
+	// set by an Ingress rule. It's empty for Services discovered
+	// directly from the Kubernetes Service API.
+	Host string
+
+	// RemoteAddress, if set, overrides the default
+	// "name.namespace.svc" DNS lookup used to reach RemotePort, e.g. a
+	// concrete Pod IP resolved from an EndpointSlice.
+	RemoteAddress string
 }
 
 // ServicePort defines a port that is exposed
@@ -41,79 +67,218 @@ type Service struct {
 type ServicePort struct {
 	RemotePort uint
 	LocalPort  uint
+
+	// Protocol is the IP protocol this port is exposed over. It
+	// defaults to corev1.ProtocolTCP, matching the Kubernetes Service
+	// API's own default.
+	Protocol corev1.Protocol
+}
+
+// ResourceDiscoverer finds Kubernetes resources of a particular kind
+// and converts them into our internal Service model. Client.Discover
+// always runs the plain Service discoverer and additionally runs
+// whichever of these are enabled via DiscoveryOptions, passing along
+// the same DiscoverOptions (namespace/selector scoping, the
+// ExposeAnnotation opt-out) used to scope the base Service listing.
+type ResourceDiscoverer interface {
+	Discover(ctx context.Context, opts DiscoverOptions) ([]*Service, error)
+}
+
+// DiscoveryOptions controls which Kubernetes resource kinds Discover
+// looks at beyond plain ClusterIP Services.
+type DiscoveryOptions struct {
+	// IncludeIngress also exposes Services fronted by networkingv1.Ingress
+	// resources, one per rule host.
+	IncludeIngress bool
+
+	// IncludeEndpointSlices also exposes bare discoveryv1.EndpointSlice
+	// resources that have no backing Service, e.g. externally-managed
+	// backends.
+	IncludeEndpointSlices bool
+
+	// IncludeHeadless also exposes headless (ClusterIP: None) Services by
+	// resolving their individual endpoint addresses, which are otherwise
+	// unreachable via the Service's (nonexistent) ClusterIP.
+	IncludeHeadless bool
 }
 
 type Client struct {
-	k kubernetes.Interface
+	k    kubernetes.Interface
+	opts DiscoveryOptions
+
+	// informer is the shared informer backing Watch. It's created
+	// lazily on first use by Informer, guarded by informerOnce so
+	// concurrent callers can't race each other constructing it.
+	informer     cache.SharedIndexInformer
+	informerOnce sync.Once
+
+	// informerRunOnce guards informer.Run, which must only ever be
+	// started once for the lifetime of the Client: it's shared across
+	// every Watch call, so a second Watch call must not start (or stop)
+	// it again.
+	informerRunOnce sync.Once
 }
 
 // NewClient creates a new discovery client that is
 // capable of finding remote services and creating proxies
-func NewClient(k kubernetes.Interface) *Client {
+func NewClient(k kubernetes.Interface, opts DiscoveryOptions) *Client {
 	return &Client{
-		k,
+		k:    k,
+		opts: opts,
+	}
+}
+
+// discoverers returns the additional ResourceDiscoverers enabled by
+// c.opts, to be merged with the base Service listing.
+func (c *Client) discoverers() []ResourceDiscoverer {
+	discoverers := make([]ResourceDiscoverer, 0)
+
+	if c.opts.IncludeIngress {
+		discoverers = append(discoverers, &ingressDiscoverer{c.k})
+	}
+
+	if c.opts.IncludeEndpointSlices {
+		discoverers = append(discoverers, &endpointSliceDiscoverer{c.k})
+	}
+
+	if c.opts.IncludeHeadless {
+		discoverers = append(discoverers, &headlessServiceDiscoverer{c.k})
+	}
+
+	return discoverers
+}
+
+// DiscoverOptions scopes a single Discover call to a subset of
+// Services, instead of every Service in the cluster.
+type DiscoverOptions struct {
+	// Namespaces restricts discovery to the given namespaces. When more
+	// than one is given, each namespace is listed concurrently and the
+	// results merged. An empty slice means every namespace.
+	Namespaces []string
+
+	// LabelSelector restricts discovery to Services matching this
+	// Kubernetes label selector.
+	LabelSelector string
+
+	// FieldSelector restricts discovery to Services matching this
+	// Kubernetes field selector.
+	FieldSelector string
+
+	// ExcludeSystemNamespaces drops Services in kube-system,
+	// kube-public, and kube-node-lease from the result, regardless of
+	// Namespaces.
+	ExcludeSystemNamespaces bool
+}
+
+// Discover lists Services visible to opts, plus anything found by the
+// additional ResourceDiscoverers enabled on c. opts is variadic purely
+// so callers that want every Service in the cluster can keep calling
+// Discover(ctx); passing more than one DiscoverOptions is an error.
+func (c *Client) Discover(ctx context.Context, opts ...DiscoverOptions) ([]*Service, error) {
+	var opt DiscoverOptions
+	switch len(opts) {
+	case 0:
+	case 1:
+		opt = opts[0]
+	default:
+		return nil, errors.New("discover: at most one DiscoverOptions may be provided")
 	}
+
+	namespaces := namespacesFor(opt)
+	listOpts := listOptionsFor(opt)
+
+	var s []*Service
+	if len(namespaces) == 1 {
+		found, err := c.discoverNamespace(ctx, namespaces[0], listOpts)
+		if err != nil {
+			return nil, err
+		}
+
+		s = found
+	} else {
+		// multiple namespaces were explicitly requested, so list them
+		// concurrently rather than paying for N sequential round trips
+		var (
+			mu   sync.Mutex
+			wg   sync.WaitGroup
+			errs []error
+		)
+
+		s = make([]*Service, 0)
+		for _, ns := range namespaces {
+			wg.Add(1)
+			go func(ns string) {
+				defer wg.Done()
+
+				found, err := c.discoverNamespace(ctx, ns, listOpts)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, err)
+					return
+				}
+				s = append(s, found...)
+			}(ns)
+		}
+		wg.Wait()
+
+		if len(errs) > 0 {
+			return nil, errs[0]
+		}
+	}
+
+	for _, d := range c.discoverers() {
+		ds, err := d.Discover(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		s = append(s, ds...)
+	}
+
+	if opt.ExcludeSystemNamespaces {
+		s = excludeSystemNamespaces(s)
+	}
+
+	return s, nil
 }
 
-func (c *Client) Discover(ctx context.Context) ([]*Service, error) {
+// discoverNamespace lists, and converts to our internal model, every
+// Service in namespace matching listOpts, handling pagination and
+// 410/ResourceExpired restarts the same way the original unscoped
+// Discover loop did. Services carrying ExposeAnnotation: "false" are
+// skipped even though they matched listOpts. When c.opts.IncludeHeadless
+// is set, headless (ClusterIP: None) Services are skipped here too,
+// since they have no ClusterIP to dial and are instead emitted,
+// correctly, per-address by headlessServiceDiscoverer.
+func (c *Client) discoverNamespace(ctx context.Context, namespace string, listOpts metav1.ListOptions) ([]*Service, error) {
 	cont := ""
 
 	s := make([]*Service, 0)
 	for {
-		l, err := c.k.CoreV1().Services("").List(ctx, metav1.ListOptions{Continue: cont})
+		listOpts.Continue = cont
+		l, err := c.k.CoreV1().Services(namespace).List(ctx, listOpts)
 		if kerrors.IsResourceExpired(err) {
 			// we need a consistent list, so we just restart fetching
 			s = make([]*Service, 0)
 			cont = ""
 			continue
 		} else if err != nil {
-			return nil, errors.Wrap(err, "failed to retrieve kubernetes services")
+			return nil, errors.Wrapf(err, "failed to retrieve kubernetes services in namespace %q", namespace)
 		}
 
-		for _, kserv := range l.Items {
-			serv := &Service{
-				Name:      kserv.Name,
-				Namespace: kserv.Namespace,
-				Ports:     make([]*ServicePort, 0),
+		for i := range l.Items {
+			kserv := &l.Items[i]
+			if kserv.Annotations[ExposeAnnotation] == "false" {
+				continue
 			}
 
-			remaps := make(map[string]uint)
-			for k, v := range kserv.Annotations {
-				if !strings.HasPrefix(k, RemapAnnotationPrefix) {
-					continue
-				}
-
-				// for now, skip invalid ports. We may want to expose
-				// this someday in the future
-				portOverride, err := strconv.ParseUint(v, 0, 6)
-				if err != nil {
-					continue
-				}
-
-				// TODO(jaredallard): determine if ToLower is really needed here.
-				// for ease of use we transform this remap to lowercase here
-				// when processing ports we also convert their name to lowercase
-				// just in case. Though the spec may enforce this to begin with.
-				portName := strings.ToLower(strings.TrimPrefix(k, RemapAnnotationPrefix))
-				remaps[portName] = uint(portOverride)
-			}
-
-			// convert the Kubernetes ports into our own internal data model
-			// we also handle overriding localPorts via the RemapAnnotation here.
-			for _, p := range kserv.Spec.Ports {
-				localPort := uint(p.Port)
-				override := remaps[strings.ToLower(p.Name)]
-				if override != 0 {
-					localPort = override
-				}
-
-				serv.Ports = append(serv.Ports, &ServicePort{
-					RemotePort: uint(p.Port),
-					LocalPort:  localPort,
-				})
+			if c.opts.IncludeHeadless && kserv.Spec.ClusterIP == corev1NoneClusterIP {
+				continue
 			}
 
-			s = append(s, serv)
+			s = append(s, serviceFromKube(kserv))
 		}
 
 		// if we don't have a continue, then we break and return
@@ -125,4 +290,141 @@ func (c *Client) Discover(ctx context.Context) ([]*Service, error) {
 	}
 
 	return s, nil
-}
\ No newline at end of file
+}
+
+// namespacesFor returns opts.Namespaces, or a single all-namespaces
+// entry when none were given, so callers can always range over it
+// instead of special-casing the "no namespace scoping" case.
+func namespacesFor(opts DiscoverOptions) []string {
+	if len(opts.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+
+	return opts.Namespaces
+}
+
+// listOptionsFor builds the metav1.ListOptions carrying opts' label
+// and field selectors, shared by every ResourceDiscoverer so they all
+// honor the same scoping Client.Discover applies to the base Service
+// listing.
+func listOptionsFor(opts DiscoverOptions) metav1.ListOptions {
+	return metav1.ListOptions{
+		LabelSelector: opts.LabelSelector,
+		FieldSelector: opts.FieldSelector,
+	}
+}
+
+// excludeSystemNamespaces drops any Service whose Namespace is a
+// well-known Kubernetes system namespace.
+func excludeSystemNamespaces(s []*Service) []*Service {
+	out := make([]*Service, 0, len(s))
+	for _, serv := range s {
+		if systemNamespaces[serv.Namespace] {
+			continue
+		}
+
+		out = append(out, serv)
+	}
+
+	return out
+}
+
+// protocolSuffixes maps the protocol qualifier suffix allowed on a
+// remap annotation key (e.g. the "-udp" in "remap-dns-udp") to the
+// corev1.Protocol it selects. A key with no recognized suffix remaps
+// the TCP port of that name, matching the Kubernetes Service default.
+var protocolSuffixes = map[string]corev1.Protocol{
+	"tcp":  corev1.ProtocolTCP,
+	"udp":  corev1.ProtocolUDP,
+	"sctp": corev1.ProtocolSCTP,
+}
+
+// remapKey builds the key remapsFromAnnotations and serviceFromKube
+// use to look up a port's remap, keyed by name+protocol so e.g. a
+// "dns" port exposed on both TCP and UDP doesn't collide.
+func remapKey(name string, protocol corev1.Protocol) string {
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+
+	return name + "/" + string(protocol)
+}
+
+// remapsFromAnnotations extracts the RemapAnnotationPrefix annotations
+// from an arbitrary resource's annotations, keyed by remapKey, so the
+// remap logic can be shared across every ResourceDiscoverer. A key may
+// optionally be qualified with a protocol suffix, e.g.
+// "remap-dns-udp" remaps the UDP "dns" port rather than the (default)
+// TCP one.
+func remapsFromAnnotations(annotations map[string]string) map[string]uint {
+	remaps := make(map[string]uint)
+	for k, v := range annotations {
+		if !strings.HasPrefix(k, RemapAnnotationPrefix) {
+			continue
+		}
+
+		// for now, skip invalid ports. We may want to expose
+		// this someday in the future. Ports are 16-bit (0-65535); a
+		// smaller bit size here would silently reject valid ports like
+		// 5353.
+		portOverride, err := strconv.ParseUint(v, 0, 16)
+		if err != nil {
+			continue
+		}
+
+		// TODO(jaredallard): determine if ToLower is really needed here.
+		// for ease of use we transform this remap to lowercase here
+		// when processing ports we also convert their name to lowercase
+		// just in case. Though the spec may enforce this to begin with.
+		portName := strings.ToLower(strings.TrimPrefix(k, RemapAnnotationPrefix))
+
+		protocol := corev1.ProtocolTCP
+		for suffix, proto := range protocolSuffixes {
+			if trimmed := strings.TrimSuffix(portName, "-"+suffix); trimmed != portName {
+				portName, protocol = trimmed, proto
+				break
+			}
+		}
+
+		remaps[remapKey(portName, protocol)] = uint(portOverride)
+	}
+
+	return remaps
+}
+
+// serviceFromKube converts a Kubernetes Service into our own internal
+// data model, handling overriding of localPorts via the
+// RemapAnnotationPrefix annotations. It's shared between Discover and
+// Watch so both paths apply the remap logic identically.
+func serviceFromKube(kserv *corev1.Service) *Service {
+	serv := &Service{
+		Name:      kserv.Name,
+		Namespace: kserv.Namespace,
+		Ports:     make([]*ServicePort, 0),
+	}
+
+	remaps := remapsFromAnnotations(kserv.Annotations)
+
+	// convert the Kubernetes ports into our own internal data model
+	// we also handle overriding localPorts via the RemapAnnotation here.
+	for _, p := range kserv.Spec.Ports {
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+
+		localPort := uint(p.Port)
+		override := remaps[remapKey(strings.ToLower(p.Name), protocol)]
+		if override != 0 {
+			localPort = override
+		}
+
+		serv.Ports = append(serv.Ports, &ServicePort{
+			RemotePort: uint(p.Port),
+			LocalPort:  localPort,
+			Protocol:   protocol,
+		})
+	}
+
+	return serv
+}
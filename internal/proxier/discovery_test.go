@@ -0,0 +1,135 @@
+// Copyright 2020 Jared Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package proxier
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRemapsFromAnnotations(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]uint
+	}{
+		{
+			name:        "no annotations",
+			annotations: nil,
+			want:        map[string]uint{},
+		},
+		{
+			name: "unqualified key defaults to tcp",
+			annotations: map[string]string{
+				RemapAnnotationPrefix + "http": "8080",
+			},
+			want: map[string]uint{
+				remapKey("http", corev1.ProtocolTCP): 8080,
+			},
+		},
+		{
+			name: "protocol-qualified keys don't collide",
+			annotations: map[string]string{
+				RemapAnnotationPrefix + "dns":      "5300",
+				RemapAnnotationPrefix + "dns-udp":  "5353",
+				RemapAnnotationPrefix + "dns-sctp": "5354",
+			},
+			want: map[string]uint{
+				remapKey("dns", corev1.ProtocolTCP):  5300,
+				remapKey("dns", corev1.ProtocolUDP):  5353,
+				remapKey("dns", corev1.ProtocolSCTP): 5354,
+			},
+		},
+		{
+			name: "full 16-bit port range is accepted",
+			annotations: map[string]string{
+				RemapAnnotationPrefix + "dns-udp": "5353",
+				RemapAnnotationPrefix + "high":    "65535",
+			},
+			want: map[string]uint{
+				remapKey("dns", corev1.ProtocolUDP):  5353,
+				remapKey("high", corev1.ProtocolTCP): 65535,
+			},
+		},
+		{
+			name: "non-remap annotations are ignored",
+			annotations: map[string]string{
+				"some-other-annotation": "8080",
+			},
+			want: map[string]uint{},
+		},
+		{
+			name: "invalid port values are skipped",
+			annotations: map[string]string{
+				RemapAnnotationPrefix + "http": "not-a-port",
+			},
+			want: map[string]uint{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := remapsFromAnnotations(tc.annotations)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d remaps, want %d: %+v", len(got), len(tc.want), got)
+			}
+
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Errorf("remaps[%q] = %d, want %d", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestServiceFromKubeAppliesProtocolAwareRemap(t *testing.T) {
+	kserv := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "dns",
+			Namespace: "default",
+			Annotations: map[string]string{
+				RemapAnnotationPrefix + "dns-udp": "5353",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	serv := serviceFromKube(kserv)
+	if len(serv.Ports) != 2 {
+		t.Fatalf("got %d ports, want 2", len(serv.Ports))
+	}
+
+	for _, p := range serv.Ports {
+		switch p.Protocol {
+		case corev1.ProtocolTCP:
+			if p.LocalPort != 53 {
+				t.Errorf("tcp port: LocalPort = %d, want unchanged 53", p.LocalPort)
+			}
+		case corev1.ProtocolUDP:
+			if p.LocalPort != 5353 {
+				t.Errorf("udp port: LocalPort = %d, want remapped 5353", p.LocalPort)
+			}
+		default:
+			t.Errorf("unexpected protocol %q", p.Protocol)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2020 Jared Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package proxier
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// resyncPeriod controls how often the shared informer re-lists
+// Services from its local cache to re-deliver them as synthetic
+// updates, guarding against missed watch events.
+const resyncPeriod = 30 * time.Second
+
+// EventType describes the kind of change a ServiceEvent represents.
+type EventType string
+
+const (
+	// ServiceEventAdd is emitted when a Service is observed for the
+	// first time.
+	ServiceEventAdd EventType = "ADD"
+
+	// ServiceEventUpdate is emitted when a previously observed Service
+	// changes.
+	ServiceEventUpdate EventType = "UPDATE"
+
+	// ServiceEventDelete is emitted when a Service is removed.
+	ServiceEventDelete EventType = "DELETE"
+)
+
+// ServiceEvent is a single change to a Service as observed by the
+// shared informer backing Watch.
+type ServiceEvent struct {
+	Type     EventType
+	Old, New *Service
+}
+
+// Informer returns the SharedIndexInformer backing Watch, creating it
+// on first use. It can be used to wait for the initial cache sync or
+// to register additional event handlers outside of Watch. Safe for
+// concurrent use; the informer is only ever constructed once.
+func (c *Client) Informer() cache.SharedIndexInformer {
+	c.informerOnce.Do(func() {
+		c.informer = cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+					return c.k.CoreV1().Services("").List(context.Background(), opts)
+				},
+				WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+					return c.k.CoreV1().Services("").Watch(context.Background(), opts)
+				},
+			},
+			&corev1.Service{},
+			resyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		)
+	})
+
+	return c.informer
+}
+
+// Watch starts the shared informer, if it isn't already running, and
+// returns a channel of ServiceEvents describing Services being added,
+// updated, or removed, deduped by namespace/name. The informer's
+// Reflector handles ResourceExpired/410 restarts transparently by
+// relisting, the same case the polling Discover loop handles
+// explicitly. The returned channel is closed once ctx is canceled.
+//
+// Watch may be called more than once on the same Client: every call
+// shares the same underlying informer (only the first call actually
+// starts it, via informerRunOnce), but each gets its own channel and
+// event handler, closed independently off its own ctx.
+func (c *Client) Watch(ctx context.Context) (<-chan ServiceEvent, error) {
+	informer := c.Informer()
+
+	ch := make(chan ServiceEvent)
+
+	var mu sync.Mutex
+	seen := make(map[string]*Service)
+	key := func(namespace, name string) string { return namespace + "/" + name }
+
+	// send delivers ev on ch, but gives up as soon as ctx is canceled so
+	// a handler (and the shared informer, which won't finish delivering
+	// an event to any handler until every handler call does) can never
+	// block forever on a consumer that's stopped reading. chMu keeps ch
+	// from being closed while a send on it is pending, and chClosed
+	// makes sends after the close a no-op instead of a panic.
+	var (
+		chMu     sync.RWMutex
+		chClosed bool
+	)
+	send := func(ev ServiceEvent) {
+		chMu.RLock()
+		defer chMu.RUnlock()
+		if chClosed {
+			return
+		}
+
+		select {
+		case ch <- ev:
+		case <-ctx.Done():
+		}
+	}
+
+	//nolint:errcheck // handler funcs can't fail in a way we can act on
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			kserv, ok := obj.(*corev1.Service)
+			if !ok {
+				return
+			}
+
+			serv := serviceFromKube(kserv)
+
+			mu.Lock()
+			seen[key(serv.Namespace, serv.Name)] = serv
+			mu.Unlock()
+
+			send(ServiceEvent{Type: ServiceEventAdd, New: serv})
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldKServ, ok := oldObj.(*corev1.Service)
+			if !ok {
+				return
+			}
+			newKServ, ok := newObj.(*corev1.Service)
+			if !ok {
+				return
+			}
+
+			oldServ := serviceFromKube(oldKServ)
+			newServ := serviceFromKube(newKServ)
+
+			mu.Lock()
+			seen[key(newServ.Namespace, newServ.Name)] = newServ
+			mu.Unlock()
+
+			send(ServiceEvent{Type: ServiceEventUpdate, Old: oldServ, New: newServ})
+		},
+		DeleteFunc: func(obj interface{}) {
+			kserv, ok := obj.(*corev1.Service)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					return
+				}
+				kserv, ok = tombstone.Obj.(*corev1.Service)
+				if !ok {
+					return
+				}
+			}
+
+			serv := serviceFromKube(kserv)
+
+			mu.Lock()
+			k := key(serv.Namespace, serv.Name)
+			last, ok := seen[k]
+			if ok {
+				serv = last
+			}
+			delete(seen, k)
+			mu.Unlock()
+
+			send(ServiceEvent{Type: ServiceEventDelete, Old: serv})
+		},
+	})
+
+	// informer.Run is shared by every Watch call and must only ever be
+	// started once, by whichever call gets there first; that first
+	// call's ctx governs the informer's lifetime for all of them. ch,
+	// on the other hand, is this call's own, so it's closed directly
+	// off this call's own ctx instead of off informer.Run returning.
+	c.informerRunOnce.Do(func() {
+		go informer.Run(ctx.Done())
+	})
+
+	go func() {
+		<-ctx.Done()
+
+		chMu.Lock()
+		defer chMu.Unlock()
+		chClosed = true
+		close(ch)
+	}()
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return nil, errors.New("failed to sync service informer cache")
+	}
+
+	return ch, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 Jared Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package proxier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// waitForEvent reads a single ServiceEvent off ch, failing the test
+// if none arrives before a short deadline.
+func waitForEvent(t *testing.T, ch <-chan ServiceEvent) ServiceEvent {
+	t.Helper()
+
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed before an event was delivered")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return ServiceEvent{}
+	}
+}
+
+func TestWatchDeliversAddUpdateDeleteEvents(t *testing.T) {
+	kserv := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 80}}},
+	}
+
+	k := fake.NewSimpleClientset()
+	c := NewClient(k, DiscoveryOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := c.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+
+	if _, err := k.CoreV1().Services(kserv.Namespace).Create(ctx, kserv, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+
+	ev := waitForEvent(t, ch)
+	if ev.Type != ServiceEventAdd || ev.New == nil || ev.New.Name != "web" {
+		t.Fatalf("got %+v, want an ADD event for %q", ev, "web")
+	}
+
+	kserv.Spec.Ports[0].Port = 8080
+	if _, err := k.CoreV1().Services(kserv.Namespace).Update(ctx, kserv, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update service: %v", err)
+	}
+
+	ev = waitForEvent(t, ch)
+	if ev.Type != ServiceEventUpdate || ev.New == nil || ev.New.Name != "web" {
+		t.Fatalf("got %+v, want an UPDATE event for %q", ev, "web")
+	}
+
+	if err := k.CoreV1().Services(kserv.Namespace).Delete(ctx, kserv.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("delete service: %v", err)
+	}
+
+	ev = waitForEvent(t, ch)
+	if ev.Type != ServiceEventDelete || ev.Old == nil || ev.Old.Name != "web" {
+		t.Fatalf("got %+v, want a DELETE event for %q", ev, "web")
+	}
+}
+
+func TestWatchClosesChannelOnContextCancel(t *testing.T) {
+	k := fake.NewSimpleClientset()
+	c := NewClient(k, DiscoveryOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := c.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("got an event, want the channel closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for channel to close")
+	}
+}
+
+// TestWatchCalledTwiceDoesNotPanic reproduces a panic where a second
+// Watch call on the same Client would observe the shared informer
+// already running, immediately close its own channel, and then panic
+// the first time the still-running informer delivered an event to
+// that call's handler over the now-closed channel.
+func TestWatchCalledTwiceDoesNotPanic(t *testing.T) {
+	k := fake.NewSimpleClientset()
+	c := NewClient(k, DiscoveryOptions{})
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+
+	ch1, err := c.Watch(ctx1)
+	if err != nil {
+		t.Fatalf("first Watch: %v", err)
+	}
+
+	ch2, err := c.Watch(ctx2)
+	if err != nil {
+		t.Fatalf("second Watch: %v", err)
+	}
+
+	kserv := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	if _, err := k.CoreV1().Services(kserv.Namespace).Create(ctx1, kserv, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+
+	ev1 := waitForEvent(t, ch1)
+	if ev1.Type != ServiceEventAdd {
+		t.Fatalf("got %+v on first channel, want an ADD event", ev1)
+	}
+
+	ev2 := waitForEvent(t, ch2)
+	if ev2.Type != ServiceEventAdd {
+		t.Fatalf("got %+v on second channel, want an ADD event", ev2)
+	}
+
+	cancel2()
+
+	select {
+	case _, ok := <-ch2:
+		if ok {
+			t.Fatal("got an event, want the second channel closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for second channel to close")
+	}
+
+	// The shared informer must still be alive for the first caller,
+	// unaffected by the second call's ctx being canceled.
+	kserv.Spec.Ports[0].Port = 9090
+	if _, err := k.CoreV1().Services(kserv.Namespace).Update(ctx1, kserv, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update service: %v", err)
+	}
+
+	ev1 = waitForEvent(t, ch1)
+	if ev1.Type != ServiceEventUpdate {
+		t.Fatalf("got %+v on first channel, want an UPDATE event", ev1)
+	}
+}